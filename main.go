@@ -4,19 +4,42 @@ package main
 
 import (
 	// Standard lib
+	"bufio"
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	// Third-party
 	log "github.com/Sirupsen/logrus"
+	"github.com/oklog/ulid/v2"
+	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/sync/errgroup"
+	yaml "gopkg.in/yaml.v2"
 )
 
 const (
@@ -24,14 +47,153 @@ const (
 	DEFAULT_BACKENDS = "http://127.0.0.1:6060,http://127.0.0.1:6061,http://127.0.0.1:6062"
 	// Default port to use for the server
 	DEFAULT_PORT = "8080"
+	// Default backend selection strategy to use
+	DEFAULT_STRATEGY = "random"
+	// Default weight applied to a backend when none is given
+	DEFAULT_WEIGHT = 1
+	// Default path used when health checking backend servers
+	DEFAULT_HEALTH_PATH = "/healthz"
+	// Default interval between backend health checks
+	DEFAULT_HEALTH_INTERVAL = 10 * time.Second
+	// Default timeout used for a single health check request
+	DEFAULT_HEALTH_TIMEOUT = 2 * time.Second
+	// Key routes are stored under when a request's Host doesn't match a
+	// more specific entry
+	DEFAULT_ROUTE_KEY = "default"
+	// Default time to wait for in-flight requests to drain on shutdown
+	DEFAULT_DRAIN_TIMEOUT = 30 * time.Second
+	// Interval at which the shutdown path polls in-flight request counts
+	DRAIN_POLL_INTERVAL = 100 * time.Millisecond
+	// Default port the `/metrics` endpoint is served on
+	DEFAULT_METRICS_PORT = "9900"
 )
 
 type (
 	// Struct representing a single backend server to proxy requests to
 	BackendServer struct {
-		Proxy *httputil.ReverseProxy
-		Url   *url.URL
+		Proxy    *httputil.ReverseProxy
+		Url      *url.URL
+		Weight   int
+		InFlight int64
+		// Number of additional attempts to make against this backend before
+		// failing over to the next entry in its route
+		Retries int
+		// Time to sleep after a failed attempt against this backend, before
+		// retrying it or failing over to the next entry in its route
+		Delay time.Duration
+		// Upper bound on how long to wait for this backend's response headers
+		Timeout time.Duration
+		// Request rewriting to apply before forwarding to this backend
+		Rewrite RewriteRules
+
+		// Guards Alive, since it's flipped from the health-check goroutine
+		// while being read from request-handling goroutines
+		mu    sync.RWMutex
+		alive bool
+	}
+
+	// Router maps a request's Host header to an ordered list of backend
+	// servers to attempt, falling back to DEFAULT_ROUTE_KEY when the Host
+	// has no dedicated entry. Each route owns its own BackendSelector so
+	// round-robin/weighted rotation state is never shared across unrelated
+	// hosts. State is swapped atomically so a SIGHUP reload never blocks or
+	// drops an in-flight lookup
+	Router struct {
+		state atomic.Pointer[routerState]
+	}
+
+	// routerState is one atomically-swapped snapshot of the router's routes
+	// and their per-route selectors
+	routerState struct {
+		routes    map[string][]*BackendServer
+		selectors map[string]BackendSelector
+	}
+
+	// backendConfigEntry represents a single backend entry for a host as
+	// read from the `-config` YAML file
+	backendConfigEntry struct {
+		Backend string              `yaml:"backend"`
+		Retries int                 `yaml:"retries"`
+		Delay   float64             `yaml:"delay"`
+		Timeout float64             `yaml:"timeout"`
+		Rewrite *rewriteConfigEntry `yaml:"rewrite"`
+	}
+
+	// rewriteConfigEntry describes request rewriting to apply before a
+	// request reaches this backend
+	rewriteConfigEntry struct {
+		StripPrefix string                `yaml:"strip_prefix"`
+		AddHeaders  map[string]string     `yaml:"add_headers"`
+		SetHost     bool                  `yaml:"set_host"`
+		BasicAuth   *basicAuthConfigEntry `yaml:"basic_auth"`
+	}
+
+	// basicAuthConfigEntry holds credentials to inject via req.SetBasicAuth
+	basicAuthConfigEntry struct {
+		User string `yaml:"user"`
+		Pass string `yaml:"pass"`
+	}
+
+	// RewriteRules holds the resolved request-rewriting behavior for a
+	// single backend, applied by its Director after the single-host join
+	RewriteRules struct {
+		StripPrefix   string
+		AddHeaders    map[string]string
+		SetHost       bool
+		BasicAuthUser string
+		BasicAuthPass string
+	}
+
+	// Listener describes a single address this server binds to, along with
+	// its optional TLS certificate pair and PROXY protocol support
+	Listener struct {
+		Addr       string
+		TLSCert    string
+		TLSKey     string
+		ProxyProto bool
+	}
+
+	// listenerFlags collects one or more `-listen` flag values into a slice
+	// of Listener structs
+	listenerFlags []Listener
+
+	// certStore holds TLS certificates registered by one or more TLS
+	// listeners, keyed by the DNS names they cover, so a single `tls.Config`
+	// can serve the right certificate based on SNI
+	certStore struct {
+		mu    sync.RWMutex
+		certs map[string]*tls.Certificate
+	}
+
+	// instrumentedTransport wraps a backend's http.Transport to record the
+	// proxy_request_duration_seconds histogram for every round trip
+	instrumentedTransport struct {
+		next    http.RoundTripper
+		backend string
+	}
+
+	// BackendSelector picks a single backend server out of a pool of live,
+	// healthy backends
+	BackendSelector interface {
+		Select(servers []*BackendServer) (*BackendServer, error)
 	}
+
+	// RandomSelector picks a semi-random backend server from the pool
+	RandomSelector struct{}
+
+	// RoundRobinSelector cycles through the pool in order
+	RoundRobinSelector struct {
+		counter uint64
+	}
+
+	// WeightedRoundRobinSelector cycles through the pool, giving heavier-weighted
+	// backends proportionally more turns than lighter ones
+	WeightedRoundRobinSelector struct {
+		counter uint64
+	}
+
+	// LeastConnectionsSelector picks the backend with the fewest in-flight requests
+	LeastConnectionsSelector struct{}
 )
 
 var (
@@ -39,95 +201,908 @@ var (
 	port *string
 	// Comma-separated string of backend servers requests should be sent to
 	backends *string
-	// Slice of zero or more backend server structs
-	backendServers []*BackendServer
+	// Backend selection strategy to use, one of: random, rr, wrr, least.
+	// It picks the backend for upgrade requests only; all other requests
+	// try their route's backends in configured order
+	strategy *string
+	// Path to issue backend health check requests against
+	healthPath *string
+	// Path to a YAML file describing per-host backend routes; when empty,
+	// `-backends` is used to populate a single default route
+	configPath *string
+	// Holds the active set of host -> backend routes
+	router = &Router{}
+	// One or more `-listen` flag values describing addresses to bind to
+	listeners listenerFlags
+	// Registered TLS certificates, shared by every TLS listener for SNI lookups
+	certs = &certStore{certs: map[string]*tls.Certificate{}}
+	// Servers started by startServer(), one per configured listener
+	httpServers []*http.Server
+	// Coordinates the Serve() goroutines for every listener so the first
+	// shutdown error among them can be propagated
+	serveGroup errgroup.Group
+	// How long to wait for in-flight requests to drain on shutdown
+	drainTimeout *time.Duration
+	// Port the `/metrics` endpoint is served on, separate from proxied traffic
+	metricsPort *string
+
+	// Guards ulidEntropy, which is not safe for concurrent use on its own
+	ulidMu      sync.Mutex
+	ulidEntropy = ulid.Monotonic(cryptorand.Reader, 0)
+
+	// Prometheus metrics
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_requests_total",
+		Help: "Total number of requests proxied to a backend, by response code and method",
+	}, []string{"backend", "code", "method"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "proxy_request_duration_seconds",
+		Help: "Time spent waiting on a backend's response",
+	}, []string{"backend"})
+	backendUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_backend_up",
+		Help: "Whether the last health check for a backend succeeded",
+	}, []string{"backend"})
+	backendInflight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_backend_inflight",
+		Help: "Number of requests currently in-flight to a backend",
+	}, []string{"backend"})
+	retriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_retries_total",
+		Help: "Total number of times a request was retried or failed over to another backend",
+	}, []string{"backend"})
 )
 
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, backendUp, backendInflight, retriesTotal)
+}
+
+// newRequestID generates a ULID to identify a single proxied request,
+// suitable for correlating access log entries with the `X-Request-Id`
+// response header
+func newRequestID() string {
+	ulidMu.Lock()
+	defer ulidMu.Unlock()
+
+	return ulid.MustNew(ulid.Timestamp(time.Now()), ulidEntropy).String()
+}
+
+// RoundTrip delegates to the wrapped transport and records the
+// proxy_request_duration_seconds histogram for the backend it targets
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	requestDuration.WithLabelValues(t.backend).Observe(time.Since(start).Seconds())
+
+	return resp, err
+}
+
+// String returns the flag.Value representation of the configured listeners
+func (l *listenerFlags) String() string {
+	specs := make([]string, len(*l))
+	for i, listener := range *l {
+		specs[i] = listener.Addr
+	}
+
+	return strings.Join(specs, ",")
+}
+
+// Set parses a single `-listen` flag value of the form
+// `addr|cert=path|key=path|proxyproto=true` and appends the resulting
+// Listener to the flag's value
+func (l *listenerFlags) Set(value string) error {
+	parts := strings.Split(value, "|")
+
+	listener := Listener{Addr: strings.TrimSpace(parts[0])}
+
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		switch key {
+		case "cert":
+			listener.TLSCert = val
+		case "key":
+			listener.TLSKey = val
+		case "proxyproto":
+			listener.ProxyProto = val == "true"
+		}
+	}
+
+	*l = append(*l, listener)
+
+	return nil
+}
+
+// Register loads a certificate/key pair and indexes it by every DNS name
+// (and common name) it covers, so GetCertificate can find it by SNI
+func (c *certStore) Register(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	names := leaf.DNSNames
+	if len(leaf.Subject.CommonName) > 0 {
+		names = append(names, leaf.Subject.CommonName)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, name := range names {
+		c.certs[name] = &cert
+	}
+
+	return nil
+}
+
+// GetCertificate implements tls.Config's GetCertificate callback, returning
+// the certificate registered for the incoming SNI server name, or an
+// arbitrary registered certificate when none matches that name
+func (c *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if cert, ok := c.certs[hello.ServerName]; ok {
+		return cert, nil
+	}
+
+	for _, cert := range c.certs {
+		return cert, nil
+	}
+
+	return nil, fmt.Errorf("no certificate registered for server name '%s'", hello.ServerName)
+}
+
+// IsAlive returns whether the backend server is currently considered healthy
+func (b *BackendServer) IsAlive() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.alive
+}
+
+// SetAlive updates whether the backend server is currently considered healthy
+func (b *BackendServer) SetAlive(alive bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.alive = alive
+}
+
+// Lookup returns the ordered list of backend servers configured for host,
+// falling back to the default route when host has no dedicated entry
+func (r *Router) Lookup(host string) []*BackendServer {
+	state := r.state.Load()
+	if state == nil {
+		return nil
+	}
+
+	if servers, ok := state.routes[host]; ok {
+		return servers
+	}
+
+	return state.routes[DEFAULT_ROUTE_KEY]
+}
+
+// SelectorFor returns the BackendSelector scoped to host's route, falling
+// back to the default route's selector when host has no dedicated entry
+func (r *Router) SelectorFor(host string) BackendSelector {
+	state := r.state.Load()
+	if state == nil {
+		return nil
+	}
+
+	if sel, ok := state.selectors[host]; ok {
+		return sel
+	}
+
+	return state.selectors[DEFAULT_ROUTE_KEY]
+}
+
+// Set atomically replaces the full set of host -> backend routes, building a
+// fresh BackendSelector per route so in-flight lookups never observe a
+// partially-updated map and rotation state never leaks across hosts
+func (r *Router) Set(routes map[string][]*BackendServer) {
+	selectors := make(map[string]BackendSelector, len(routes))
+	for host := range routes {
+		selectors[host] = newSelector(*strategy)
+	}
+
+	r.state.Store(&routerState{routes: routes, selectors: selectors})
+}
+
+// All returns every backend server known to the router, across all routes
+func (r *Router) All() []*BackendServer {
+	state := r.state.Load()
+	if state == nil {
+		return nil
+	}
+
+	servers := make([]*BackendServer, 0, len(state.routes))
+	for _, route := range state.routes {
+		servers = append(servers, route...)
+	}
+
+	return servers
+}
+
+// Select returns a semi-random backend server from the pool
+func (s *RandomSelector) Select(servers []*BackendServer) (*BackendServer, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("No backend servers available :(")
+	}
+
+	return servers[rand.Intn(len(servers))], nil
+}
+
+// Select returns the next backend server in the pool, in order
+func (s *RoundRobinSelector) Select(servers []*BackendServer) (*BackendServer, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("No backend servers available :(")
+	}
+
+	next := atomic.AddUint64(&s.counter, 1)
+
+	return servers[next%uint64(len(servers))], nil
+}
+
+// Select returns the next backend server in the pool, weighting heavier
+// backends so they're picked proportionally more often
+func (s *WeightedRoundRobinSelector) Select(servers []*BackendServer) (*BackendServer, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("No backend servers available :(")
+	}
+
+	// Walk servers once, building a running total of weights rather than a
+	// flattened `Weight`-length slice per server, so Select stays O(n)
+	// regardless of how large the configured weights are
+	cumulative := make([]int, len(servers))
+	total := 0
+	for i, server := range servers {
+		weight := server.Weight
+		if weight < 1 {
+			weight = DEFAULT_WEIGHT
+		}
+
+		total += weight
+		cumulative[i] = total
+	}
+
+	next := atomic.AddUint64(&s.counter, 1)
+	target := int(next % uint64(total))
+
+	idx := sort.Search(len(cumulative), func(i int) bool { return cumulative[i] > target })
+
+	return servers[idx], nil
+}
+
+// Select returns the backend server in the pool with the fewest in-flight requests
+func (s *LeastConnectionsSelector) Select(servers []*BackendServer) (*BackendServer, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("No backend servers available :(")
+	}
+
+	least := servers[0]
+	for _, server := range servers[1:] {
+		if atomic.LoadInt64(&server.InFlight) < atomic.LoadInt64(&least.InFlight) {
+			least = server
+		}
+	}
+
+	return least, nil
+}
+
+// newSelector builds a BackendSelector for the given strategy name, falling
+// back to a random selector when the strategy is unrecognized
+func newSelector(strategy string) BackendSelector {
+	switch strategy {
+	case "rr":
+		return &RoundRobinSelector{}
+	case "wrr":
+		return &WeightedRoundRobinSelector{}
+	case "least":
+		return &LeastConnectionsSelector{}
+	default:
+		return &RandomSelector{}
+	}
+}
+
 // handle is the main HTTP handler function for all requests to the server
 func handle(w http.ResponseWriter, req *http.Request) {
-	// Get backend server, checking for errors
-	backendServer, err := getBackendServer()
+	requestID := newRequestID()
+	w.Header().Set("X-Request-Id", requestID)
+
+	// Look up the ordered list of backend servers configured for this request's host
+	servers := router.Lookup(req.Host)
+	if len(servers) == 0 {
+		fmt.Fprintf(w, "No backend servers available for host '%s' :(", req.Host)
+		return
+	}
+
+	var err error
+
+	// Upgrade requests (WebSockets, etc.) can't be buffered through a
+	// ResponseRecorder for retries, so proxy them straight to w on a single
+	// backend instead of going through the failover path
+	if isUpgradeRequest(req) {
+		err = proxyUpgrade(w, req, servers, requestID)
+	} else {
+		err = proxyWithFailover(w, req, servers, requestID)
+	}
+
 	if err != nil {
 		fmt.Fprint(w, err.Error())
-		return
 	}
+}
+
+// isUpgradeRequest reports whether req is asking to switch protocols
+// (e.g. a WebSocket handshake), per the Connection header's token list
+func isUpgradeRequest(req *http.Request) bool {
+	for _, token := range strings.Split(req.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// aliveBackends filters servers down to those currently considered healthy
+func aliveBackends(servers []*BackendServer) []*BackendServer {
+	alive := make([]*BackendServer, 0, len(servers))
+	for _, backendServer := range servers {
+		if backendServer.IsAlive() {
+			alive = append(alive, backendServer)
+		}
+	}
+
+	return alive
+}
+
+// proxyUpgrade proxies a protocol-upgrade request directly to a single
+// backend, bypassing the buffered failover path entirely
+func proxyUpgrade(w http.ResponseWriter, req *http.Request, servers []*BackendServer, requestID string) error {
+	candidates := aliveBackends(servers)
+	if len(candidates) == 0 {
+		return fmt.Errorf("No backend servers available :(")
+	}
+
+	backendServer, err := router.SelectorFor(req.Host).Select(candidates)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"backend":    backendServer.Url.String(),
+		"client_ip":  clientIP(req),
+		"request_id": requestID,
+	}).Info("Proxying upgrade request")
+
+	statusWriter := &statusCapturingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	serveViaBackend(backendServer, statusWriter, req)
+	requestsTotal.WithLabelValues(backendServer.Url.String(), strconv.Itoa(statusWriter.status), req.Method).Inc()
+
+	return nil
+}
+
+// statusCapturingResponseWriter wraps an http.ResponseWriter to record the
+// status code written to it while still delegating Hijack/Flush, so an
+// upgrade request's outcome can be counted in proxy_requests_total without
+// interfering with the upgrade itself
+type statusCapturingResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code before delegating to the underlying writer
+func (w *statusCapturingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack delegates to the underlying ResponseWriter's Hijacker, which the
+// upgrade path requires in order to take over the connection
+func (w *statusCapturingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+
+	return hijacker.Hijack()
+}
+
+// Flush delegates to the underlying ResponseWriter's Flusher, if it has one
+func (w *statusCapturingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
 
-	// Log request handling
-	log.Infof("Proxying request for '%s' to backend server with address: %s", req.URL.String(), backendServer.Url.String())
+// serveViaBackend proxies req through backendServer, tracking the request
+// as in-flight for the lifetime of the call even if Proxy.ServeHTTP panics
+func serveViaBackend(backendServer *BackendServer, w http.ResponseWriter, req *http.Request) {
+	backendLabel := backendServer.Url.String()
+
+	atomic.AddInt64(&backendServer.InFlight, 1)
+	backendInflight.WithLabelValues(backendLabel).Inc()
+
+	defer func() {
+		atomic.AddInt64(&backendServer.InFlight, -1)
+		backendInflight.WithLabelValues(backendLabel).Dec()
+	}()
 
-	// Use backend server to serve the request
 	backendServer.Proxy.ServeHTTP(w, req)
 }
 
-// returns a random backend server when possible, an error when not
-func getBackendServer() (*BackendServer, error) {
-	// Check for at least one backend server
-	if len(backendServers) == 0 {
-		return nil, fmt.Errorf("No backend servers available :(")
+// proxyWithFailover attempts servers in their configured order, retrying a
+// failing backend up to its configured Retries and, once those are
+// exhausted, failing over to the next candidate in the list
+func proxyWithFailover(w http.ResponseWriter, req *http.Request, servers []*BackendServer, requestID string) error {
+	candidates := aliveBackends(servers)
+	if len(candidates) == 0 {
+		return fmt.Errorf("No backend servers available :(")
+	}
+
+	// Buffer the body once so it can be replayed against every failover
+	// attempt; req.Body is only readable a single time otherwise
+	var bodyBytes []byte
+	if req.Body != nil {
+		buf, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read request body: %s", err.Error())
+		}
+
+		bodyBytes = buf
+	}
+
+	attempts := map[*BackendServer]int{}
+	var lastErr error
+
+	for len(candidates) > 0 {
+		// Always attempt the first remaining candidate, in route order, so
+		// failover follows the configured primary-then-fallback sequence
+		// rather than whatever the load-balancing strategy picks next
+		backendServer := candidates[0]
+		backendLabel := backendServer.Url.String()
+
+		// NOTE: buffering the response through a recorder means streaming
+		// responses (SSE, chunked) are held in memory until the backend
+		// finishes; this is the tradeoff made to support retry/failover
+		rec := httptest.NewRecorder()
+		attemptReq := req.Clone(req.Context())
+		attemptReq.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		attemptReq.ContentLength = int64(len(bodyBytes))
+
+		var cancel context.CancelFunc
+		if backendServer.Timeout > 0 {
+			var ctx context.Context
+			ctx, cancel = context.WithTimeout(req.Context(), backendServer.Timeout)
+			attemptReq = attemptReq.WithContext(ctx)
+		}
+
+		start := time.Now()
+		serveViaBackend(backendServer, rec, attemptReq)
+		duration := time.Since(start)
+
+		// Release this attempt's timeout context as soon as the attempt
+		// finishes, rather than deferring to the end of the whole request
+		if cancel != nil {
+			cancel()
+		}
+
+		// Count the attempt here, from rec.Code, rather than in
+		// ModifyResponse: ReverseProxy's ErrorHandler writes straight to rec
+		// on a transport error without ever calling ModifyResponse, which
+		// would otherwise leave failed attempts out of this metric entirely
+		requestsTotal.WithLabelValues(backendLabel, strconv.Itoa(rec.Code), req.Method).Inc()
+
+		accessLog := log.WithFields(log.Fields{
+			"backend":     backendLabel,
+			"status":      rec.Code,
+			"duration_ms": duration.Milliseconds(),
+			"bytes":       rec.Body.Len(),
+			"client_ip":   clientIP(req),
+			"request_id":  requestID,
+		})
+
+		if rec.Code < http.StatusInternalServerError {
+			accessLog.Info("Proxied request")
+			copyRecordedResponse(w, rec)
+			return nil
+		}
+
+		lastErr = fmt.Errorf("backend server %s responded with status %d", backendLabel, rec.Code)
+
+		attempts[backendServer]++
+		if attempts[backendServer] > backendServer.Retries {
+			candidates = removeBackend(candidates, backendServer)
+		}
+
+		if len(candidates) == 0 {
+			accessLog.Warn("Proxied request failed, no backends left to try")
+			break
+		}
+
+		accessLog.Warn("Proxied request failed, retrying")
+		retriesTotal.WithLabelValues(backendLabel).Inc()
+
+		if backendServer.Delay > 0 {
+			time.Sleep(backendServer.Delay)
+		}
+	}
+
+	return lastErr
+}
+
+// clientIP returns the request's remote address with any port stripped
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
 	}
 
-	// TO-DO: Support for marking servers as "down"
-	// TO-DO: Support for choosing a server based on number of concurrent requests to it
+	return host
+}
+
+// copyRecordedResponse writes a buffered httptest.ResponseRecorder's
+// headers, status code, and body to the real ResponseWriter
+func copyRecordedResponse(w http.ResponseWriter, rec *httptest.ResponseRecorder) {
+	for key, values := range rec.Header() {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
 
-	// Return semi-random backend server
-	return backendServers[rand.Intn(len(backendServers))], nil
+	w.WriteHeader(rec.Code)
+	rec.Body.WriteTo(w)
 }
 
-// parses and configures all available backend servers
+// removeBackend returns a copy of servers with backendServer removed
+func removeBackend(servers []*BackendServer, backendServer *BackendServer) []*BackendServer {
+	remaining := make([]*BackendServer, 0, len(servers)-1)
+	for _, server := range servers {
+		if server != backendServer {
+			remaining = append(remaining, server)
+		}
+	}
+
+	return remaining
+}
+
+// parses and configures the default route from the comma-separated
+// `-backends` flag; used as a fallback when no `-config` file is given
 func parseBackends() {
 	// Split up backends
 	splitBackends := strings.Split(*backends, ",")
 
+	defaultRoute := make([]*BackendServer, 0, len(splitBackends))
+
 	// Loop through backends, creating a new proxy for each
 	for _, backend := range splitBackends {
 		// Remove leading and trailing spaces
 		backend = strings.Trim(backend, " ")
 
+		if len(backend) == 0 {
+			continue
+		}
+
 		// TO-DO: Handle scheme checking
 
-		// Parse backend address and check validity
-		backendUrl, err := url.Parse(backend)
-		if err != nil || len(backend) == 0 {
+		// Split off any `|weight=n` suffix
+		backendAddress, weight := parseBackendWeight(backend)
+
+		backendServer, err := buildBackendServer(backendAddress, weight, 0, 0, 0, nil)
+		if err != nil {
+			log.Warnf("Skipping invalid backend '%s': %s", backend, err.Error())
 			continue
 		}
 
-		// Create new backend server
-		backendServer := &BackendServer{
-			// NOTE: `NewSingleHostReverseProxy` requires a scheme for backend URLs
-			Proxy: httputil.NewSingleHostReverseProxy(backendUrl),
-			Url:   backendUrl,
+		defaultRoute = append(defaultRoute, backendServer)
+	}
+
+	router.Set(map[string][]*BackendServer{DEFAULT_ROUTE_KEY: defaultRoute})
+
+	// Log backends
+	log.Infof("Parsed %d backend servers", len(defaultRoute))
+}
+
+// buildBackendServer constructs a BackendServer for the given address,
+// selection weight, and per-backend retry/delay/timeout settings (delay
+// and timeout are given in seconds)
+func buildBackendServer(address string, weight, retries int, delay, timeout float64, rewrite *rewriteConfigEntry) (*BackendServer, error) {
+	// Parse backend address and check validity
+	backendUrl, err := url.Parse(address)
+	if err != nil || len(address) == 0 {
+		return nil, fmt.Errorf("invalid backend address: %s", address)
+	}
+
+	transport := &http.Transport{}
+	if timeout > 0 {
+		transport.ResponseHeaderTimeout = time.Duration(timeout * float64(time.Second))
+	}
+
+	backendLabel := backendUrl.String()
+	rules := resolveRewriteRules(rewrite)
+
+	// NOTE: `NewSingleHostReverseProxy` requires a scheme for backend URLs
+	proxy := httputil.NewSingleHostReverseProxy(backendUrl)
+	singleHostDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		singleHostDirector(req)
+		applyRewrite(req, backendUrl, rules)
+	}
+	proxy.Transport = &instrumentedTransport{next: transport, backend: backendLabel}
+
+	return &BackendServer{
+		Proxy:   proxy,
+		Url:     backendUrl,
+		Weight:  weight,
+		Retries: retries,
+		Delay:   time.Duration(delay * float64(time.Second)),
+		Timeout: time.Duration(timeout * float64(time.Second)),
+		Rewrite: rules,
+		alive:   true,
+	}, nil
+}
+
+// resolveRewriteRules converts a YAML rewrite entry into its resolved form,
+// returning the zero value (no rewriting) when rewrite is nil
+func resolveRewriteRules(rewrite *rewriteConfigEntry) RewriteRules {
+	if rewrite == nil {
+		return RewriteRules{}
+	}
+
+	rules := RewriteRules{
+		StripPrefix: rewrite.StripPrefix,
+		AddHeaders:  rewrite.AddHeaders,
+		SetHost:     rewrite.SetHost,
+	}
+
+	if rewrite.BasicAuth != nil {
+		rules.BasicAuthUser = rewrite.BasicAuth.User
+		rules.BasicAuthPass = rewrite.BasicAuth.Pass
+	}
+
+	return rules
+}
+
+// applyRewrite mutates an already-directed request according to rules,
+// stripping a path prefix, injecting headers, setting basic auth
+// credentials, and overwriting the Host header as configured
+func applyRewrite(req *http.Request, backendUrl *url.URL, rules RewriteRules) {
+	if len(rules.StripPrefix) > 0 {
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, rules.StripPrefix)
+		// Clear RawPath so it's re-derived from Path; left alone, it would
+		// still reflect the pre-strip, percent-encoded path
+		req.URL.RawPath = ""
+	}
+
+	for key, value := range rules.AddHeaders {
+		req.Header.Set(key, value)
+	}
+
+	if len(rules.BasicAuthUser) > 0 {
+		req.SetBasicAuth(rules.BasicAuthUser, rules.BasicAuthPass)
+	}
+
+	if rules.SetHost {
+		req.Host = backendUrl.Host
+	}
+}
+
+// reloadBackends re-parses the `-config` file (or the `-backends` flag, when
+// no config file is given) and atomically swaps the router's routes, so
+// operators can add or remove backends without dropping connections
+func reloadBackends() {
+	if len(*configPath) > 0 {
+		routes, err := loadConfig(*configPath)
+		if err != nil {
+			log.Errorf("Failed to reload config '%s': %s", *configPath, err.Error())
+			return
 		}
 
-		// Add backend to slice
-		backendServers = append(backendServers, backendServer)
+		router.Set(routes)
+	} else {
+		parseBackends()
 	}
 
-	// Log backends
-	log.Infof("Parsed %d backend servers", len(backendServers))
+	log.Info("Reloaded backend servers")
+}
+
+// loadConfig reads a YAML file mapping request hostnames to ordered lists
+// of backend entries and builds the corresponding host -> backend routes
+func loadConfig(path string) (map[string][]*BackendServer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string][]backendConfigEntry
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	routes := make(map[string][]*BackendServer, len(raw))
+
+	for host, entries := range raw {
+		servers := make([]*BackendServer, 0, len(entries))
+
+		for _, entry := range entries {
+			backendServer, err := buildBackendServer(entry.Backend, DEFAULT_WEIGHT, entry.Retries, entry.Delay, entry.Timeout, entry.Rewrite)
+			if err != nil {
+				log.Warnf("Skipping invalid backend for host '%s': %s", host, err.Error())
+				continue
+			}
+
+			servers = append(servers, backendServer)
+		}
+
+		routes[host] = servers
+	}
+
+	return routes, nil
+}
+
+// parseBackendWeight splits a `-backends` entry of the form
+// `http://host:port|weight=3` into its address and weight, defaulting
+// the weight to DEFAULT_WEIGHT when not present or invalid
+func parseBackendWeight(backend string) (string, int) {
+	parts := strings.SplitN(backend, "|", 2)
+	if len(parts) != 2 {
+		return backend, DEFAULT_WEIGHT
+	}
+
+	address := parts[0]
+	weight := DEFAULT_WEIGHT
+
+	weightParts := strings.SplitN(parts[1], "=", 2)
+	if len(weightParts) == 2 && strings.TrimSpace(weightParts[0]) == "weight" {
+		if parsed, err := strconv.Atoi(strings.TrimSpace(weightParts[1])); err == nil && parsed > 0 {
+			weight = parsed
+		}
+	}
+
+	return address, weight
+}
+
+// healthCheckBackends periodically issues a GET request against each
+// backend server's health path, flipping its Alive state based on the result
+func healthCheckBackends() {
+	client := &http.Client{Timeout: DEFAULT_HEALTH_TIMEOUT}
+
+	for range time.Tick(DEFAULT_HEALTH_INTERVAL) {
+		for _, backendServer := range router.All() {
+			backendLabel := backendServer.Url.String()
+			healthUrl := strings.TrimRight(backendLabel, "/") + *healthPath
+
+			resp, err := client.Get(healthUrl)
+			if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+				if resp != nil {
+					resp.Body.Close()
+				}
+
+				if backendServer.IsAlive() {
+					log.Infof("Backend server marked down: %s", backendLabel)
+				}
+
+				backendServer.SetAlive(false)
+				backendUp.WithLabelValues(backendLabel).Set(0)
+				continue
+			}
+
+			resp.Body.Close()
+
+			if !backendServer.IsAlive() {
+				log.Infof("Backend server marked up: %s", backendLabel)
+			}
+
+			backendServer.SetAlive(true)
+			backendUp.WithLabelValues(backendLabel).Set(1)
+		}
+	}
 }
 
-// configures and starts up an HTTP server on a desired port
+// configures and starts up one HTTP server per configured listener
 func startServer() {
 	// Create new mux instance
 	mux := http.NewServeMux()
 
-	// Create new server instance
-	server := &http.Server{}
-
-	// Set up server
-	server.Addr = ":" + *port
-	server.Handler = mux
-	server.ReadTimeout = time.Duration(30) * time.Second
-	server.WriteTimeout = time.Duration(30) * time.Second
-
 	// Set up server routes
 	mux.Handle("/", http.HandlerFunc(handle))
 
-	// Log server start
-	log.Infof("Server running on port %s", *port)
+	// h2c lets a PROXY-protocol-wrapped, non-TLS listener still serve HTTP/2,
+	// for use behind a TLS-terminating edge that hands off h2 over plain TCP
+	h2cHandler := h2c.NewHandler(mux, &http2.Server{})
+
+	for _, listener := range listeners {
+		server := &http.Server{
+			Addr:         listener.Addr,
+			Handler:      mux,
+			ReadTimeout:  time.Duration(30) * time.Second,
+			WriteTimeout: time.Duration(30) * time.Second,
+		}
+
+		ln, err := net.Listen("tcp", listener.Addr)
+		if err != nil {
+			log.Fatalf("Failed to listen on '%s': %s", listener.Addr, err.Error())
+		}
+
+		if listener.ProxyProto {
+			// Decodes the PROXY v1/v2 header off each accepted connection so
+			// upstreams see the true client address via req.RemoteAddr
+			ln = &proxyproto.Listener{Listener: ln}
 
-	// Attempt to start the server
-	go server.ListenAndServe()
+			if len(listener.TLSCert) == 0 {
+				server.Handler = h2cHandler
+			}
+		}
+
+		if len(listener.TLSCert) > 0 {
+			if err := certs.Register(listener.TLSCert, listener.TLSKey); err != nil {
+				log.Fatalf("Failed to register certificate for '%s': %s", listener.Addr, err.Error())
+			}
+
+			server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+			ln = tls.NewListener(ln, server.TLSConfig)
+		}
+
+		httpServers = append(httpServers, server)
+
+		// Log server start
+		log.Infof("Server running on %s (tls=%t, proxyproto=%t)", listener.Addr, len(listener.TLSCert) > 0, listener.ProxyProto)
+
+		serveGroup.Go(func() error {
+			if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+				return err
+			}
+
+			return nil
+		})
+	}
+
+	// Start the background health checker for all configured backends
+	go healthCheckBackends()
+}
+
+// startMetricsServer serves Prometheus metrics on their own port and mux so
+// `/metrics` is never reachable through the proxied traffic path
+func startMetricsServer() {
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:    ":" + *metricsPort,
+		Handler: metricsMux,
+	}
+
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on '%s': %s", server.Addr, err.Error())
+	}
+
+	httpServers = append(httpServers, server)
+
+	log.Infof("Metrics server running on port %s", *metricsPort)
+
+	serveGroup.Go(func() error {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			return err
+		}
+
+		return nil
+	})
 }
 
 func main() {
@@ -136,23 +1111,119 @@ func main() {
 
 	// Get port and backend servers from flags with fallback
 	port = flag.String("port", DEFAULT_PORT, "default server port, ex: 8080")
-	backends = flag.String("backends", DEFAULT_BACKENDS, "comma-separated list of backend servers, ex: localhost:6060,localhost:6061")
+	backends = flag.String("backends", DEFAULT_BACKENDS, "comma-separated list of backend servers, ex: http://localhost:6060,http://localhost:6061|weight=3")
+	strategy = flag.String("strategy", DEFAULT_STRATEGY, "backend selection strategy for upgrade requests, one of: random, rr, wrr, least")
+	healthPath = flag.String("health-path", DEFAULT_HEALTH_PATH, "path used to health check each backend server, ex: /healthz")
+	configPath = flag.String("config", "", "path to a YAML file mapping hostnames to per-backend retry/timeout settings")
+	flag.Var(&listeners, "listen", "repeatable listener spec, ex: :80 or :443|cert=cert.pem|key=key.pem or :8443|proxyproto=true")
+	drainTimeout = flag.Duration("drain-timeout", DEFAULT_DRAIN_TIMEOUT, "how long to wait for in-flight requests to drain on shutdown")
+	metricsPort = flag.String("metrics-port", DEFAULT_METRICS_PORT, "port the /metrics endpoint is served on, ex: 9900")
 
 	// Parse flags
 	flag.Parse()
 
-	// Parse backend servers
-	parseBackends()
+	// Fall back to a single plain listener on `-port` when no `-listen` flags were given
+	if len(listeners) == 0 {
+		listeners = append(listeners, Listener{Addr: ":" + *port})
+	}
+
+	// Prefer the YAML config when given, falling back to the `-backends` flag
+	if len(*configPath) > 0 {
+		routes, err := loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Failed to load config '%s': %s", *configPath, err.Error())
+		}
+
+		router.Set(routes)
+	} else {
+		parseBackends()
+	}
 
 	// Start server
 	startServer()
+	startMetricsServer()
+
+	// Reload backends on SIGHUP without dropping connections
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
-	// Listen for and exit the application on SIGKILL or SIGINT
-	stop := make(chan os.Signal)
-	signal.Notify(stop, os.Interrupt, os.Kill)
+	go func() {
+		for range hup {
+			reloadBackends()
+		}
+	}()
+
+	// Drain and exit the application on SIGINT or SIGTERM
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	<-stop
+	log.Info("Server is shutting down")
+
+	shutdown()
+}
 
-	select {
-	case <-stop:
-		log.Info("Server is shutting down")
+// shutdown gracefully stops every listener, draining in-flight proxied
+// requests (or giving up once `-drain-timeout` elapses), then closes each
+// backend's idle connections and logs the first error returned by any
+// listener's Serve call
+func shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range httpServers {
+		wg.Add(1)
+
+		go func(server *http.Server) {
+			defer wg.Done()
+
+			if err := server.Shutdown(ctx); err != nil {
+				log.Errorf("Error shutting down listener '%s': %s", server.Addr, err.Error())
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	drainInFlight(ctx)
+
+	for _, backendServer := range router.All() {
+		instrumented, ok := backendServer.Proxy.Transport.(*instrumentedTransport)
+		if !ok {
+			continue
+		}
+
+		if transport, ok := instrumented.next.(*http.Transport); ok {
+			transport.CloseIdleConnections()
+		}
+	}
+
+	if err := serveGroup.Wait(); err != nil {
+		log.Errorf("Error while shutting down: %s", err.Error())
+	}
+}
+
+// drainInFlight blocks until every backend reports zero in-flight requests
+// or ctx is done, whichever comes first
+func drainInFlight(ctx context.Context) {
+	ticker := time.NewTicker(DRAIN_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		inFlight := int64(0)
+		for _, backendServer := range router.All() {
+			inFlight += atomic.LoadInt64(&backendServer.InFlight)
+		}
+
+		if inFlight == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Warnf("Drain timeout elapsed with %d request(s) still in-flight", inFlight)
+			return
+		case <-ticker.C:
+		}
 	}
 }